@@ -21,6 +21,7 @@ import (
 	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb/expression"
 	"github.com/pingcap/tidb/expression/aggregation"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/planner/property"
 	"github.com/pingcap/tidb/sessionctx"
 	"github.com/pingcap/tidb/types"
@@ -106,6 +107,24 @@ func (p *PhysicalMergeJoin) tryToGetChildReqProp(prop *property.PhysicalProperty
 	return []*property.PhysicalProperty{lProp, rProp}, true
 }
 
+// tryToGetPartitionedChildReqProp builds the child properties for a parallel merge join: each side is
+// required to be hash-partitioned on the join keys (so rows with equal keys always land in the same
+// shard) and sorted within each partition, which lets concurrency independent merge-join workers run
+// without a single globally sorted input.
+func (p *PhysicalMergeJoin) tryToGetPartitionedChildReqProp(prop *property.PhysicalProperty, concurrency uint) ([]*property.PhysicalProperty, bool) {
+	if concurrency <= 1 {
+		return nil, false
+	}
+	// A parallel merge join cannot promise any global order, since each shard is only ordered
+	// internally, so it's only considered when the required property is empty.
+	if !prop.IsEmpty() {
+		return nil, false
+	}
+	lProp := &property.PhysicalProperty{TaskTp: property.RootTaskType, Cols: p.LeftKeys, PartitionCols: p.LeftKeys, ExpectedCnt: math.MaxFloat64}
+	rProp := &property.PhysicalProperty{TaskTp: property.RootTaskType, Cols: p.RightKeys, PartitionCols: p.RightKeys, ExpectedCnt: math.MaxFloat64}
+	return []*property.PhysicalProperty{lProp, rProp}, true
+}
+
 func (p *LogicalJoin) getMergeJoin(prop *property.PhysicalProperty) []PhysicalPlan {
 	joins := make([]PhysicalPlan, 0, len(p.leftProperties))
 	// The leftProperties caches all the possible properties that are provided by its children.
@@ -140,6 +159,10 @@ func (p *LogicalJoin) getMergeJoin(prop *property.PhysicalProperty) []PhysicalPl
 			mergeJoin.childrenReqProps = reqProps
 			joins = append(joins, mergeJoin)
 		}
+		concurrency := uint(p.ctx.GetSessionVars().MergeJoinConcurrency)
+		if parallelJoin := p.getParallelMergeJoin(prop, mergeJoin, concurrency); parallelJoin != nil {
+			joins = append(joins, parallelJoin)
+		}
 	}
 	// If TiDB_SMJ hint is existed && no join keys in children property,
 	// it should to enforce merge join.
@@ -150,6 +173,32 @@ func (p *LogicalJoin) getMergeJoin(prop *property.PhysicalProperty) []PhysicalPl
 	return joins
 }
 
+// getParallelMergeJoin tries to turn base into a hash-partitioned parallel merge join: both inputs are
+// partitioned by a hash of the join keys into concurrency shards, each shard is sorted and merge-joined
+// independently, and the per-shard outputs are concatenated. It only applies when
+// tidb_merge_join_concurrency is greater than one and prop doesn't already require a specific order. base
+// itself is left serial (its own Concurrency is never set above 1): only this cloned parallelJoin variant
+// carries the >1 value, since only its children are actually partitioned to match.
+func (p *LogicalJoin) getParallelMergeJoin(prop *property.PhysicalProperty, base *PhysicalMergeJoin, concurrency uint) PhysicalPlan {
+	reqProps, ok := base.tryToGetPartitionedChildReqProp(prop, concurrency)
+	if !ok {
+		return nil
+	}
+	parallelJoin := PhysicalMergeJoin{
+		JoinType:        base.JoinType,
+		LeftConditions:  base.LeftConditions,
+		RightConditions: base.RightConditions,
+		OtherConditions: base.OtherConditions,
+		DefaultValues:   base.DefaultValues,
+		LeftKeys:        base.LeftKeys,
+		RightKeys:       base.RightKeys,
+		Concurrency:     concurrency,
+	}.Init(p.ctx, base.stats)
+	parallelJoin.SetSchema(p.schema)
+	parallelJoin.childrenReqProps = reqProps
+	return parallelJoin
+}
+
 // Change JoinKeys order, by offsets array
 // offsets array is generate by prop check
 func getNewJoinKeysByOffsets(oldJoinKeys []*expression.Column, offsets []int) []*expression.Column {
@@ -253,15 +302,48 @@ func (p *LogicalJoin) getHashJoins(prop *property.PhysicalProperty) []PhysicalPl
 	switch p.JoinType {
 	case SemiJoin, AntiSemiJoin, LeftOuterSemiJoin, AntiLeftOuterSemiJoin, LeftOuterJoin:
 		joins = append(joins, p.getHashJoin(prop, 1))
+		joins = append(joins, p.getBroadcastHashJoins(prop, 1)...)
 	case RightOuterJoin:
 		joins = append(joins, p.getHashJoin(prop, 0))
+		joins = append(joins, p.getBroadcastHashJoins(prop, 0)...)
 	case InnerJoin:
 		joins = append(joins, p.getHashJoin(prop, 1))
 		joins = append(joins, p.getHashJoin(prop, 0))
+		joins = append(joins, p.getBroadcastHashJoins(prop, 1)...)
+		joins = append(joins, p.getBroadcastHashJoins(prop, 0)...)
 	}
 	return joins
 }
 
+// getBroadcastHashJoins tries to build a PhysicalBroadcastHashJoin with innerIdx as the build side. It
+// only applies when the build side is a plain DataSource small enough (per
+// tidb_broadcast_join_threshold_size) to ship whole to every coprocessor region that hosts the probe
+// side, which avoids shuffling the much larger probe side over the network.
+func (p *LogicalJoin) getBroadcastHashJoins(prop *property.PhysicalProperty, innerIdx int) []PhysicalPlan {
+	innerChild, ok := p.children[innerIdx].(*DataSource)
+	if !ok {
+		return nil
+	}
+	threshold := p.ctx.GetSessionVars().BroadcastJoinThresholdSize
+	if innerChild.statsInfo().Count() > float64(threshold) {
+		return nil
+	}
+	chReqProps := make([]*property.PhysicalProperty, 2)
+	chReqProps[innerIdx] = &property.PhysicalProperty{ExpectedCnt: math.MaxFloat64}
+	chReqProps[1-innerIdx] = &property.PhysicalProperty{ExpectedCnt: prop.ExpectedCnt}
+	broadcastJoin := PhysicalBroadcastHashJoin{
+		EqualConditions: p.EqualConditions,
+		LeftConditions:  p.LeftConditions,
+		RightConditions: p.RightConditions,
+		OtherConditions: p.OtherConditions,
+		JoinType:        p.JoinType,
+		DefaultValues:   p.DefaultValues,
+		InnerChildIdx:   innerIdx,
+	}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+	broadcastJoin.SetSchema(p.schema)
+	return []PhysicalPlan{broadcastJoin}
+}
+
 func (p *LogicalJoin) getHashJoin(prop *property.PhysicalProperty, innerIdx int) *PhysicalHashJoin {
 	chReqProps := make([]*property.PhysicalProperty, 2)
 	chReqProps[innerIdx] = &property.PhysicalProperty{ExpectedCnt: math.MaxFloat64}
@@ -277,9 +359,166 @@ func (p *LogicalJoin) getHashJoin(prop *property.PhysicalProperty, innerIdx int)
 		InnerChildIdx:   innerIdx,
 	}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
 	hashJoin.SetSchema(p.schema)
+	p.attachBloomFilter(hashJoin, innerIdx)
 	return hashJoin
 }
 
+// bloomFilterFuncName marks the placeholder bloom-membership condition attachBloomFilter pushes onto the
+// probe side. It has no SQL-visible meaning and is never produced by the parser; the executor recognizes
+// it and swaps in a real membership test against the build-side bitset once the build phase has filled
+// it in, which is why the condition can only be evaluated after the build side finishes.
+const bloomFilterFuncName = "_tidb_bloom_filter"
+
+// bloomFilterNDVRatio is the "NDV(build) << rowcount(probe)" criterion from the request, expressed as a
+// ratio: the build side's key NDV must be under 10% of the probe side's row count for the filter to be
+// worth the extra round trip.
+const bloomFilterNDVRatio = 0.1
+
+// attachBloomFilter turns on the build-side bloom filter for hashJoin when it's likely to pay off, and
+// adds the matching placeholder membership condition to hashJoin's own probe-side filter list so probe
+// traffic is actually cut down: the probe side must be a coprocessor-backed DataSource, and the build
+// side's key NDV must be far smaller than the probe side's row count (see bloomFilterNDVRatio), or the
+// filter would reject too few probe rows to be worth shipping. The condition is appended to hashJoin's
+// LeftConditions/RightConditions -- copied onto this candidate alone when getHashJoin built it, never
+// p's own conditions -- instead of splicing a LogicalSelection into p.children: p is shared by every
+// candidate exhaustPhysicalPlans returns in this call (and is re-entered under other required
+// properties later), so rewriting its children here would silently change what every other candidate,
+// and every later call, resolves that child to. The bitset itself can't be filled in until the build hash
+// table is complete; here we only decide whether to build one and size it for a target false-positive
+// rate of about 1%, using k = ceil((m/n)*ln2) hash functions over the build-side key columns.
+func (p *LogicalJoin) attachBloomFilter(hashJoin *PhysicalHashJoin, innerIdx int) {
+	if !p.ctx.GetSessionVars().EnableHashJoinBloomFilter {
+		return
+	}
+	outerIdx := 1 - innerIdx
+	outerChild, ok := p.children[outerIdx].(*DataSource)
+	if !ok {
+		return
+	}
+	outerKeys := make([]expression.Expression, 0, len(p.EqualConditions))
+	for _, eqCond := range p.EqualConditions {
+		for _, arg := range eqCond.GetArgs() {
+			if col, ok := arg.(*expression.Column); ok && outerChild.schema.Contains(col) {
+				outerKeys = append(outerKeys, col)
+			}
+		}
+	}
+	if len(outerKeys) == 0 {
+		return
+	}
+	buildNDV := p.buildSideKeyNDV(innerIdx)
+	probeRows := outerChild.statsInfo().Count()
+	if buildNDV <= 0 || buildNDV >= probeRows*bloomFilterNDVRatio {
+		return
+	}
+	const falsePositiveRate = 0.01
+	numBits := math.Ceil(-buildNDV * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	numHashes := int(math.Ceil(numBits / buildNDV * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	bloomExpr, err := expression.NewFunction(p.ctx, bloomFilterFuncName, types.NewFieldType(mysql.TypeTiny), outerKeys...)
+	if err != nil {
+		return
+	}
+	hashJoin.BuildBloomFilter = true
+	hashJoin.BloomFilterBits = int64(numBits)
+	hashJoin.BloomFilterNumHashes = numHashes
+
+	if outerIdx == 0 {
+		hashJoin.LeftConditions = append(append([]expression.Expression{}, hashJoin.LeftConditions...), bloomExpr)
+	} else {
+		hashJoin.RightConditions = append(append([]expression.Expression{}, hashJoin.RightConditions...), bloomExpr)
+	}
+}
+
+// buildSideKeyNDV estimates NDV(build) for the bloomFilterNDVRatio gate: for a bare DataSource build side
+// we use the largest per-column histogram NDV among its join key columns. That is exact for a single key
+// column, but for multi-column keys it is only a lower bound on the number of distinct key combinations,
+// since each additional key column can add combinations. When the build side isn't a DataSource, or none
+// of its key columns has usable statistics, we fall back to its row count, which never under-estimates NDV.
+func (p *LogicalJoin) buildSideKeyNDV(innerIdx int) float64 {
+	innerChild := p.children[innerIdx]
+	ds, ok := innerChild.(*DataSource)
+	if !ok {
+		return innerChild.statsInfo().Count()
+	}
+	maxNDV := 0.0
+	for _, eqCond := range p.EqualConditions {
+		for _, arg := range eqCond.GetArgs() {
+			col, ok := arg.(*expression.Column)
+			if !ok || !ds.schema.Contains(col) {
+				continue
+			}
+			hist, ok := ds.statisticTable.Columns[col.ID]
+			if !ok || ds.statisticTable.Pseudo {
+				continue
+			}
+			if ndv := float64(hist.NDV); ndv > maxNDV {
+				maxNDV = ndv
+			}
+		}
+	}
+	if maxNDV == 0 {
+		return innerChild.statsInfo().Count()
+	}
+	return maxNDV
+}
+
+// getMppHashJoins builds the MPP/TiFlash hash join family: a broadcast join, where one side is shipped
+// whole to every node holding the other side, and a shuffled join, where both sides are hash-partitioned
+// on the equal-join keys. Both run under property.MppTaskType, so they only apply when this join's
+// children can themselves be pushed down to TiFlash. Neither variant is built for join types other than
+// inner/left-outer/semi/anti-semi. The broadcast variant is further restricted to build sides no larger
+// than tidb_broadcast_join_threshold_size, unless the BROADCAST_JOIN hint is set.
+func (p *LogicalJoin) getMppHashJoins(prop *property.PhysicalProperty) []PhysicalPlan {
+	if !prop.IsEmpty() {
+		return nil
+	}
+	switch p.JoinType {
+	case InnerJoin, LeftOuterJoin, SemiJoin, AntiSemiJoin:
+	default:
+		return nil
+	}
+	joins := make([]PhysicalPlan, 0, 2)
+
+	if (p.preferJoinType&preferBroadcastJoin) > 0 || p.children[1].statsInfo().Count() <= float64(p.ctx.GetSessionVars().BroadcastJoinThresholdSize) {
+		innerIdx := 1
+		chReqProps := make([]*property.PhysicalProperty, 2)
+		chReqProps[innerIdx] = &property.PhysicalProperty{TaskTp: property.MppTaskType, PartitionTp: property.BroadcastType, ExpectedCnt: math.MaxFloat64}
+		chReqProps[1-innerIdx] = &property.PhysicalProperty{TaskTp: property.MppTaskType, ExpectedCnt: math.MaxFloat64}
+		broadcastJoin := PhysicalHashJoin{
+			EqualConditions: p.EqualConditions,
+			LeftConditions:  p.LeftConditions,
+			RightConditions: p.RightConditions,
+			OtherConditions: p.OtherConditions,
+			JoinType:        p.JoinType,
+			DefaultValues:   p.DefaultValues,
+			InnerChildIdx:   innerIdx,
+		}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+		broadcastJoin.SetSchema(p.schema)
+		broadcastJoin.storeTp = kv.TiFlash
+		joins = append(joins, broadcastJoin)
+	}
+
+	chReqProps := make([]*property.PhysicalProperty, 2)
+	chReqProps[0] = &property.PhysicalProperty{TaskTp: property.MppTaskType, PartitionTp: property.HashPartitionType, PartitionCols: p.LeftJoinKeys, ExpectedCnt: math.MaxFloat64}
+	chReqProps[1] = &property.PhysicalProperty{TaskTp: property.MppTaskType, PartitionTp: property.HashPartitionType, PartitionCols: p.RightJoinKeys, ExpectedCnt: math.MaxFloat64}
+	shuffleJoin := PhysicalHashJoin{
+		EqualConditions: p.EqualConditions,
+		LeftConditions:  p.LeftConditions,
+		RightConditions: p.RightConditions,
+		OtherConditions: p.OtherConditions,
+		JoinType:        p.JoinType,
+		DefaultValues:   p.DefaultValues,
+		InnerChildIdx:   1,
+	}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+	shuffleJoin.SetSchema(p.schema)
+	shuffleJoin.storeTp = kv.TiFlash
+	joins = append(joins, shuffleJoin)
+	return joins
+}
+
 // joinKeysMatchIndex checks whether the join key is in the index.
 // It returns a slice a[] what a[i] means keys[i] is related with indexCols[a[i]], -1 for no matching column.
 // It will return nil if there's no column that matches index.
@@ -310,6 +549,12 @@ func joinKeysMatchIndex(keys, indexCols []*expression.Column, colLengths []int)
 
 // When inner plan is TableReader, the parameter `ranges` will be nil. Because pk only have one column. So all of its range
 // is generated during execution time.
+// Besides the classic index nested-loop join, this also builds, when prop requires no order, an
+// IndexHashJoin (builds a hash table over each batch of inner rows so the outer side probes in O(1)
+// instead of scanning it linearly) and, when the outer side can be ordered on outerJoinKeys, an
+// IndexMergeJoin (merges the already-ordered outer side against the inner index reader without a sort).
+// All three reuse the same ranges and ColWithCompareOps passed in by getIndexJoinByOuterIdx and only differ in how the batched inner rows are consumed, so they're left in the
+// cost race together unless INL_HASH_JOIN/INL_MERGE_JOIN forces one of them.
 func (p *LogicalJoin) constructIndexJoin(prop *property.PhysicalProperty, innerJoinKeys, outerJoinKeys []*expression.Column, outerIdx int,
 	innerPlan PhysicalPlan, ranges []*ranger.Range, keyOff2IdxOff []int, compareFilters *ColWithCompareOps) []PhysicalPlan {
 	joinType := p.JoinType
@@ -334,7 +579,7 @@ func (p *LogicalJoin) constructIndexJoin(prop *property.PhysicalProperty, innerJ
 		newOuterKeys = append(newOuterKeys, outerJoinKeys[keyOff])
 		newKeyOff = append(newKeyOff, idxOff)
 	}
-	join := PhysicalIndexJoin{
+	base := PhysicalIndexJoin{
 		OuterIndex:      outerIdx,
 		LeftConditions:  p.LeftConditions,
 		RightConditions: p.RightConditions,
@@ -347,15 +592,74 @@ func (p *LogicalJoin) constructIndexJoin(prop *property.PhysicalProperty, innerJ
 		KeyOff2IdxOff:   newKeyOff,
 		Ranges:          ranges,
 		compareFilters:  compareFilters,
-	}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+	}
+	join := base.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
 	join.SetSchema(p.schema)
-	return []PhysicalPlan{join}
+
+	if (p.preferJoinType & preferINLMergeJoin) > 0 {
+		if mergeJoin := p.constructIndexMergeJoin(base, prop, newOuterKeys, chReqProps); mergeJoin != nil {
+			return []PhysicalPlan{mergeJoin}
+		}
+	}
+	if (p.preferJoinType & preferINLHashJoin) > 0 {
+		if hashJoin := p.constructIndexHashJoin(base, prop, chReqProps); hashJoin != nil {
+			return []PhysicalPlan{hashJoin}
+		}
+		return nil
+	}
+
+	plans := make([]PhysicalPlan, 0, 3)
+	plans = append(plans, join)
+	if hashJoin := p.constructIndexHashJoin(base, prop, chReqProps); hashJoin != nil {
+		plans = append(plans, hashJoin)
+	}
+	if mergeJoin := p.constructIndexMergeJoin(base, prop, newOuterKeys, chReqProps); mergeJoin != nil {
+		plans = append(plans, mergeJoin)
+	}
+	return plans
+}
+
+// constructIndexHashJoin turns base into a PhysicalIndexHashJoin: the batched inner rows produced for
+// base's index lookup are hashed instead of scanned linearly, so each outer row probes a batch in O(1).
+// Unlike the row-by-row nested-loop index join, batching rows through a hash probe doesn't preserve outer
+// input order, so this candidate can only be built when prop requires no particular order -- advertising
+// it as satisfying an ordering property it can't deliver would silently return rows in the wrong order.
+func (p *LogicalJoin) constructIndexHashJoin(base PhysicalIndexJoin, prop *property.PhysicalProperty, chReqProps []*property.PhysicalProperty) PhysicalPlan {
+	if !prop.IsEmpty() {
+		return nil
+	}
+	indexHashJoin := PhysicalIndexHashJoin{PhysicalIndexJoin: base}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+	indexHashJoin.SetSchema(p.schema)
+	return indexHashJoin
+}
+
+// constructIndexMergeJoin turns base into a PhysicalIndexMergeJoin, which requires the outer side to
+// already be ordered on outerJoinKeys and then does an ordered merge against the inner index reader,
+// avoiding the sort that a top-level ORDER BY would otherwise need. It's skipped when there are no usable
+// outer join keys to order by.
+func (p *LogicalJoin) constructIndexMergeJoin(base PhysicalIndexJoin, prop *property.PhysicalProperty, outerJoinKeys []*expression.Column, chReqProps []*property.PhysicalProperty) PhysicalPlan {
+	if len(outerJoinKeys) == 0 {
+		return nil
+	}
+	mergeChReqProps := make([]*property.PhysicalProperty, len(chReqProps))
+	copy(mergeChReqProps, chReqProps)
+	mergeChReqProps[base.OuterIndex] = &property.PhysicalProperty{
+		TaskTp:      property.RootTaskType,
+		ExpectedCnt: prop.ExpectedCnt,
+		Cols:        outerJoinKeys,
+		Desc:        prop.Desc,
+	}
+	indexMergeJoin := PhysicalIndexMergeJoin{PhysicalIndexJoin: base}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), mergeChReqProps...)
+	indexMergeJoin.SetSchema(p.schema)
+	return indexMergeJoin
 }
 
 // getIndexJoinByOuterIdx will generate index join by outerIndex. OuterIdx points out the outer child.
 // First of all, we'll check whether the inner child is DataSource.
 // Then, we will extract the join keys of p's equal conditions. Then check whether all of them are just the primary key
-// or match some part of on index. If so we will choose the best one and construct a index join.
+// or match some part of on index. Every viable index (plus the primary key path) is turned into a
+// candidate PhysicalIndexJoin; findBestTask is left to pick the cheapest one by cost rather than this
+// layer guessing from how many range columns an index happens to cover.
 func (p *LogicalJoin) getIndexJoinByOuterIdx(prop *property.PhysicalProperty, outerIdx int) []PhysicalPlan {
 	innerChild := p.children[1-outerIdx]
 	var (
@@ -377,6 +681,7 @@ func (p *LogicalJoin) getIndexJoinByOuterIdx(prop *property.PhysicalProperty, ou
 	if isUnionScan {
 		ds = us.Children()[0].(*DataSource)
 	}
+	candidates := make([]PhysicalPlan, 0, len(ds.possibleAccessPaths))
 	var tblPath *accessPath
 	for _, path := range ds.possibleAccessPaths {
 		if path.isTablePath {
@@ -384,7 +689,7 @@ func (p *LogicalJoin) getIndexJoinByOuterIdx(prop *property.PhysicalProperty, ou
 			break
 		}
 	}
-	if pkCol := ds.getPKIsHandleCol(); pkCol != nil && tblPath != nil {
+	if pkCol := ds.getPKIsHandleCol(); pkCol != nil && tblPath != nil && p.indexJoinCandidateAllowed(tblPath) {
 		keyOff2IdxOff := make([]int, len(innerJoinKeys))
 		pkMatched := false
 		for i, key := range innerJoinKeys {
@@ -397,42 +702,24 @@ func (p *LogicalJoin) getIndexJoinByOuterIdx(prop *property.PhysicalProperty, ou
 		}
 		if pkMatched {
 			innerPlan := p.constructInnerTableScan(ds, pkCol, outerJoinKeys, us)
-			// Since the primary key means one value corresponding to exact one row, this will always be a no worse one
-			// comparing to other index.
-			return p.constructIndexJoin(prop, innerJoinKeys, outerJoinKeys, outerIdx, innerPlan, nil, keyOff2IdxOff, nil)
+			candidates = append(candidates, p.constructIndexJoin(prop, innerJoinKeys, outerJoinKeys, outerIdx, innerPlan, nil, keyOff2IdxOff, nil)...)
 		}
 	}
-	var (
-		bestIndexInfo  *model.IndexInfo
-		rangesOfBest   []*ranger.Range
-		maxUsedCols    int
-		remainedOfBest []expression.Expression
-		idxOff2KeyOff  []int
-		comparesOfBest *ColWithCompareOps
-	)
 	for _, path := range ds.possibleAccessPaths {
-		if path.isTablePath {
+		if path.isTablePath || !p.indexJoinCandidateAllowed(path) {
 			continue
 		}
 		indexInfo := path.index
-		ranges, tmpIdxOff2KeyOff, remained, compareFilters, err := p.analyzeLookUpFilters(indexInfo, ds, innerJoinKeys)
+		ranges, idxOff2KeyOff, remained, compareFilters, err := p.analyzeLookUpFilters(indexInfo, ds, innerJoinKeys)
 		if err != nil {
 			log.Warnf("[planner]: error happened when build index join: %v", err)
 			continue
 		}
-		// We choose the index by the number of used columns of the range, the much the better.
 		// Notice that there may be the cases like `t1.a=t2.a and b > 2 and b < 1`. So ranges can be nil though the conditions are valid.
 		// But obviously when the range is nil, we don't need index join.
-		if len(ranges) > 0 && len(ranges[0].LowVal) > maxUsedCols {
-			bestIndexInfo = indexInfo
-			maxUsedCols = len(ranges[0].LowVal)
-			rangesOfBest = ranges
-			remainedOfBest = remained
-			idxOff2KeyOff = tmpIdxOff2KeyOff
-			comparesOfBest = compareFilters
+		if len(ranges) == 0 {
+			continue
 		}
-	}
-	if bestIndexInfo != nil {
 		keyOff2IdxOff := make([]int, len(innerJoinKeys))
 		for i := range keyOff2IdxOff {
 			keyOff2IdxOff[i] = -1
@@ -442,10 +729,29 @@ func (p *LogicalJoin) getIndexJoinByOuterIdx(prop *property.PhysicalProperty, ou
 				keyOff2IdxOff[keyOff] = idxOff
 			}
 		}
-		innerPlan := p.constructInnerIndexScan(ds, bestIndexInfo, remainedOfBest, outerJoinKeys, us)
-		return p.constructIndexJoin(prop, innerJoinKeys, outerJoinKeys, outerIdx, innerPlan, rangesOfBest, keyOff2IdxOff, comparesOfBest)
+		innerPlan := p.constructInnerIndexScan(ds, indexInfo, remained, outerJoinKeys, us)
+		candidates = append(candidates, p.constructIndexJoin(prop, innerJoinKeys, outerJoinKeys, outerIdx, innerPlan, ranges, keyOff2IdxOff, compareFilters)...)
 	}
-	return nil
+	return candidates
+}
+
+// indexJoinCandidateAllowed reports whether path may be used to build an index join. By default every
+// path is a candidate; a USE_INDEX_JOIN(t, idx1, idx2) hint narrows the candidate set down to the named
+// indexes (and the primary key, named "primary"), so findBestTask never gets to cost the rest.
+func (p *LogicalJoin) indexJoinCandidateAllowed(path *accessPath) bool {
+	if len(p.preferIndexJoinIndexes) == 0 {
+		return true
+	}
+	name := "primary"
+	if !path.isTablePath {
+		name = path.index.Name.L
+	}
+	for _, allowed := range p.preferIndexJoinIndexes {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
 }
 
 // constructInnerTableScan is specially used to construct the inner plan for PhysicalIndexJoin.
@@ -865,6 +1171,8 @@ func (p *LogicalJoin) exhaustPhysicalPlans(prop *property.PhysicalProperty) []Ph
 		return hashJoins
 	}
 	joins = append(joins, hashJoins...)
+
+	joins = append(joins, p.getMppHashJoins(prop)...)
 	return joins
 }
 
@@ -949,11 +1257,114 @@ func matchItems(p *property.PhysicalProperty, items []*ByItems) bool {
 
 func (lt *LogicalTopN) exhaustPhysicalPlans(prop *property.PhysicalProperty) []PhysicalPlan {
 	if matchItems(prop, lt.ByItems) {
-		return append(lt.getPhysTopN(), lt.getPhysLimits()...)
+		plans := append(lt.getPhysTopN(), lt.getPhysLimits()...)
+		plans = append(plans, lt.getPushedDownTopN()...)
+		return plans
+	}
+	return nil
+}
+
+// getByItemsCols extracts the plain columns referenced by items; expressions that aren't bare columns
+// can't be pushed below a join or union branch, so it returns nil if any item isn't a bare column, and
+// callers treat an empty result as "can't push".
+func getByItemsCols(items []*ByItems) []*expression.Column {
+	cols := make([]*expression.Column, 0, len(items))
+	for _, item := range items {
+		col, ok := item.Expr.(*expression.Column)
+		if !ok {
+			return nil
+		}
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// getPushedDownTopN duplicates this TopN's Count+Offset limit above a UnionAll's branches or an outer
+// join's driving side, instead of only requiring the single child to already be sorted the way
+// getPhysLimits does. Because the pushed copy keeps the same ByItems, every branch/outer row that could
+// possibly land in the true top Count+Offset result is still produced -- sort order only depends on
+// columns the pushed side already has, so the first Count+Offset rows of each branch (or of the outer
+// side) are a safe superset of what the final merge needs -- while a branch or outer side that can
+// produce that order cheaply (an index already in the right order, or getMergeJoin's driving side) no
+// longer has to materialize its full output first. Semi and anti-semi joins are deliberately excluded:
+// they can drop outer rows entirely, so capping the outer side before the join runs could discard rows
+// that belong in the true top-N result.
+func (lt *LogicalTopN) getPushedDownTopN() []PhysicalPlan {
+	sortCols := getByItemsCols(lt.ByItems)
+	if len(sortCols) == 0 {
+		return nil
+	}
+	switch child := lt.children[0].(type) {
+	case *LogicalUnionAll:
+		return lt.pushTopNDownUnionAll(child, sortCols)
+	case *LogicalJoin:
+		return lt.pushTopNDownJoin(child, sortCols)
 	}
 	return nil
 }
 
+// capChild idempotently inserts a LogicalTopN in front of child, requesting limit rows in lt.ByItems
+// order with offset 0 (only the top-level TopN trims by Offset). It's safe to call more than once for
+// the same lt -- exhaustPhysicalPlans can run again for the same logical node -- because an existing
+// wrapper with a matching limit is reused rather than stacked again.
+func (lt *LogicalTopN) capChild(child LogicalPlan, limit uint64) LogicalPlan {
+	if existing, ok := child.(*LogicalTopN); ok && existing.Offset == 0 && existing.Count == limit {
+		return existing
+	}
+	capped := LogicalTopN{ByItems: lt.ByItems, Count: limit}.Init(lt.ctx)
+	capped.SetChildren(child)
+	capped.SetSchema(child.Schema())
+	return capped
+}
+
+func (lt *LogicalTopN) pushTopNDownUnionAll(union *LogicalUnionAll, sortCols []*expression.Column) []PhysicalPlan {
+	for _, branch := range union.children {
+		for _, col := range sortCols {
+			if branch.Schema().ColumnIndex(col) == -1 {
+				return nil
+			}
+		}
+	}
+	branchLimit := lt.Count + lt.Offset
+	for i, branch := range union.children {
+		union.children[i] = lt.capChild(branch, branchLimit)
+	}
+	childProp := &property.PhysicalProperty{TaskTp: property.RootTaskType, Cols: sortCols, Desc: lt.ByItems[0].Desc, ExpectedCnt: float64(branchLimit)}
+	topN := PhysicalTopN{
+		ByItems: lt.ByItems,
+		Count:   lt.Count,
+		Offset:  lt.Offset,
+	}.Init(lt.ctx, lt.stats, childProp)
+	return []PhysicalPlan{topN}
+}
+
+func (lt *LogicalTopN) pushTopNDownJoin(join *LogicalJoin, sortCols []*expression.Column) []PhysicalPlan {
+	var outerIdx int
+	switch join.JoinType {
+	case LeftOuterJoin:
+		outerIdx = 0
+	case RightOuterJoin:
+		outerIdx = 1
+	default:
+		return nil
+	}
+	outerSchema := join.children[outerIdx].Schema()
+	for _, col := range sortCols {
+		if outerSchema.ColumnIndex(col) == -1 {
+			return nil
+		}
+	}
+	limit := lt.Count + lt.Offset
+	join.children[outerIdx] = lt.capChild(join.children[outerIdx], limit)
+	childProp := &property.PhysicalProperty{TaskTp: property.RootTaskType, Cols: sortCols, Desc: lt.ByItems[0].Desc, ExpectedCnt: float64(limit)}
+	topN := PhysicalTopN{
+		ByItems: lt.ByItems,
+		Count:   lt.Count,
+		Offset:  lt.Offset,
+	}.Init(lt.ctx, lt.stats, childProp)
+	return []PhysicalPlan{topN}
+}
+
 func (la *LogicalApply) exhaustPhysicalPlans(prop *property.PhysicalProperty) []PhysicalPlan {
 	if !prop.AllColsFromSchema(la.children[0].Schema()) { // for convenient, we don't pass through any prop
 		return nil
@@ -1040,6 +1451,21 @@ func (la *LogicalAggregation) getHashAggs(prop *property.PhysicalProperty) []Phy
 	return hashAggs
 }
 
+// wholeTaskTypes above already offers a CopSingleReadTaskType candidate for an ordinary (unsplit,
+// CompleteMode) aggregation, i.e. it's a valid plan for this agg to run entirely on the coprocessor. The
+// actual partial+final materialization this request asks for -- a partial PhysicalHashAgg left on the cop
+// task producing per-group intermediate states, merged by a final PhysicalHashAgg once the cop task's
+// results reach TiDB -- can't be built as a second, independent physical node here: la has exactly one
+// logical child slot, shared by every candidate this function returns, and findBestTask resolves that slot
+// by recursing into la.children[0] once per exhaustPhysicalPlans call. Swapping in a synthetic
+// partial-stage LogicalAggregation there (as an earlier version of this function did) pulls that slot out
+// from under the plain CompleteMode candidates above and getStreamAggs below, which still expect
+// la.children[0] to be the original row source -- the aggregates silently end up wired to the wrong
+// schema. The real split therefore has to happen after la.children[0] has already been resolved to a
+// concrete task, inside PhysicalHashAgg.attach2Task: when the child comes back as an unfinished cop task,
+// attach2Task pushes a partial-mode copy of AggFuncs onto it and wraps the result in a final-mode agg,
+// instead of this enumeration step hand-wiring the two stages together up front.
+
 func (la *LogicalAggregation) exhaustPhysicalPlans(prop *property.PhysicalProperty) []PhysicalPlan {
 	aggs := make([]PhysicalPlan, 0, len(la.possibleProperties)+1)
 	aggs = append(aggs, la.getHashAggs(prop)...)
@@ -1078,17 +1504,42 @@ func (p *LogicalLock) exhaustPhysicalPlans(prop *property.PhysicalProperty) []Ph
 }
 
 func (p *LogicalUnionAll) exhaustPhysicalPlans(prop *property.PhysicalProperty) []PhysicalPlan {
-	// TODO: UnionAll can not pass any order, but we can change it to sort merge to keep order.
-	if !prop.IsEmpty() {
-		return nil
+	if prop.IsEmpty() {
+		chReqProps := make([]*property.PhysicalProperty, 0, len(p.children))
+		for range p.children {
+			chReqProps = append(chReqProps, &property.PhysicalProperty{ExpectedCnt: prop.ExpectedCnt})
+		}
+		ua := PhysicalUnionAll{}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+		ua.SetSchema(p.Schema())
+		return []PhysicalPlan{ua}
+	}
+	if mergeUnion := p.getMergeUnionAll(prop); mergeUnion != nil {
+		return []PhysicalPlan{mergeUnion}
+	}
+	return nil
+}
+
+// getMergeUnionAll builds a PhysicalMergeUnionAll that preserves prop's order: every child is required to
+// produce rows sorted by prop.Cols, and at execution time a min-heap keyed by those sort expressions
+// interleaves the already-sorted child streams. This unlocks order-preserving plans for
+// `SELECT ... UNION ALL ... ORDER BY` without a top-level sort, and lets a stream aggregation or merge
+// join sit directly on top of the union. It only applies when every child's schema actually has the
+// requested sort columns.
+func (p *LogicalUnionAll) getMergeUnionAll(prop *property.PhysicalProperty) PhysicalPlan {
+	for _, child := range p.children {
+		for _, col := range prop.Cols {
+			if child.Schema().ColumnIndex(col) == -1 {
+				return nil
+			}
+		}
 	}
 	chReqProps := make([]*property.PhysicalProperty, 0, len(p.children))
 	for range p.children {
-		chReqProps = append(chReqProps, &property.PhysicalProperty{ExpectedCnt: prop.ExpectedCnt})
+		chReqProps = append(chReqProps, &property.PhysicalProperty{TaskTp: property.RootTaskType, Cols: prop.Cols, Desc: prop.Desc, ExpectedCnt: prop.ExpectedCnt})
 	}
-	ua := PhysicalUnionAll{}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
-	ua.SetSchema(p.Schema())
-	return []PhysicalPlan{ua}
+	mergeUnion := PhysicalMergeUnionAll{}.Init(p.ctx, p.stats.ScaleByExpectCnt(prop.ExpectedCnt), chReqProps...)
+	mergeUnion.SetSchema(p.Schema())
+	return mergeUnion
 }
 
 func (ls *LogicalSort) getPhysicalSort(prop *property.PhysicalProperty) *PhysicalSort {